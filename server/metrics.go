@@ -0,0 +1,174 @@
+/*
+ * This file is part of Chihaya.
+ *
+ * Chihaya is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Chihaya is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Chihaya.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"bytes"
+	cdb "chihaya/database"
+	"chihaya/util"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/zeebo/bencode"
+	"net/http"
+	"time"
+)
+
+// metricsRegistry is the single source of truth for everything /stats
+// and /metrics report; both render from it so they can never drift.
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	announceTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "chihaya_announces_total",
+		Help: "Announces processed, by event type.",
+	}, []string{"event"})
+
+	scrapeTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "chihaya_scrapes_total",
+		Help: "Scrapes processed.",
+	})
+
+	failureTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "chihaya_failures_total",
+		Help: "Failure responses, by reason.",
+	}, []string{"reason"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "chihaya_request_duration_seconds",
+		Help:    "Request latency, by action.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"action"})
+
+	responseSizeBytes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "chihaya_response_size_bytes",
+		Help:    "Response body size, by action.",
+		Buckets: prometheus.ExponentialBuckets(32, 2, 10),
+	}, []string{"action"})
+
+	usersGauge    = prometheus.NewGauge(prometheus.GaugeOpts{Name: "chihaya_users", Help: "Registered users."})
+	torrentsGauge = prometheus.NewGauge(prometheus.GaugeOpts{Name: "chihaya_torrents", Help: "Tracked torrents."})
+	peersGauge    = prometheus.NewGauge(prometheus.GaugeOpts{Name: "chihaya_peers", Help: "Seeders plus leechers."})
+	seedersGauge  = prometheus.NewGauge(prometheus.GaugeOpts{Name: "chihaya_seeders", Help: "Seeding peers."})
+	leechersGauge = prometheus.NewGauge(prometheus.GaugeOpts{Name: "chihaya_leechers", Help: "Leeching peers."})
+
+	bufferPoolTakes = prometheus.NewCounter(prometheus.CounterOpts{Name: "chihaya_buffer_pool_takes_total", Help: "Buffers handed out by the pool."})
+	bufferPoolGives = prometheus.NewCounter(prometheus.CounterOpts{Name: "chihaya_buffer_pool_gives_total", Help: "Buffers returned to the pool."})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		announceTotal, scrapeTotal, failureTotal,
+		requestDuration, responseSizeBytes,
+		usersGauge, torrentsGauge, peersGauge, seedersGauge, leechersGauge,
+		bufferPoolTakes, bufferPoolGives,
+	)
+}
+
+// takeBuffer and giveBuffer are the only places allowed to touch the
+// shared bufferPool, so chihaya_buffer_pool_{takes,gives}_total always
+// match real pool traffic instead of just the ServeHTTP-level buffer.
+// There's no allocations counter: util.BufferPool doesn't report pool
+// misses, and a metric we can never increment is worse than no metric.
+func takeBuffer(pool *util.BufferPool) *bytes.Buffer {
+	bufferPoolTakes.Inc()
+	return pool.Take()
+}
+
+func giveBuffer(pool *util.BufferPool, buf *bytes.Buffer) {
+	pool.Give(buf)
+	bufferPoolGives.Inc()
+}
+
+// metricsAction collapses any action outside the known set into "other",
+// so a client hitting /<passkey>/<anything> can't inflate the
+// action-labeled metrics below with unbounded cardinality.
+func metricsAction(action string) string {
+	switch action {
+	case "announce", "scrape":
+		return action
+	default:
+		return "other"
+	}
+}
+
+// observeResponse records the metrics common to every response -
+// announce, scrape, or anything rejected before reaching either:
+// latency, size, and a failure reason if the bencoded reply carries
+// one.
+func observeResponse(action string, started time.Time, body []byte) {
+	requestDuration.WithLabelValues(action).Observe(time.Since(started).Seconds())
+	responseSizeBytes.WithLabelValues(action).Observe(float64(len(body)))
+
+	var reply struct {
+		FailureReason string `bencode:"failure reason"`
+	}
+	if err := bencode.DecodeBytes(body, &reply); err == nil && reply.FailureReason != "" {
+		failureTotal.WithLabelValues(reply.FailureReason).Inc()
+	}
+}
+
+// updateDBGauges refreshes the user/torrent/peer gauges under the same
+// read locks the /stats handler has always used, so scraping metrics
+// never takes a stronger lock than the rest of the tracker, and returns
+// the same counts so /stats can render from a single source of truth.
+func updateDBGauges(db *cdb.Database) (users, torrents, peers int) {
+	db.UsersMutex.RLock()
+	users = len(db.Users)
+	db.UsersMutex.RUnlock()
+	usersGauge.Set(float64(users))
+
+	db.TorrentsMutex.RLock()
+	torrents = len(db.Torrents)
+	seeders, leechers := 0, 0
+	for _, t := range db.Torrents {
+		seeders += len(t.Seeders)
+		leechers += len(t.Leechers)
+	}
+	db.TorrentsMutex.RUnlock()
+
+	torrentsGauge.Set(float64(torrents))
+	seedersGauge.Set(float64(seeders))
+	leechersGauge.Set(float64(leechers))
+	peers = seeders + leechers
+	peersGauge.Set(float64(peers))
+	return
+}
+
+// metricsHandler refreshes the user/torrent/peer gauges at scrape time -
+// a bare promhttp handler would only ever report whatever /stats last
+// left them at, including zero if /stats was never hit - and then
+// serves the registry.
+func metricsHandler(db *cdb.Database) http.Handler {
+	updateDBGauges(db)
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// renderStats keeps the legacy plain-text /stats endpoint working as a
+// thin view over the same registry /metrics reports from.
+func renderStats(handler *httpHandler) string {
+	users, torrents, peers := updateDBGauges(handler.db)
+
+	return fmt.Sprintf("Uptime: %f\nUsers: %d\nTorrents: %d\nPeers: %d\nThroughput: %d rpm\n",
+		time.Since(handler.startTime).Seconds(),
+		users,
+		torrents,
+		peers,
+		handler.throughput,
+	)
+}
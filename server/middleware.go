@@ -0,0 +1,203 @@
+/*
+ * This file is part of Chihaya.
+ *
+ * Chihaya is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Chihaya is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Chihaya.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"bytes"
+	"chihaya/config"
+	cdb "chihaya/database"
+	"chihaya/util"
+	"context"
+	"log"
+	"time"
+)
+
+// AnnounceRequest carries everything a middleware or the built-in
+// announce logic needs, so operators can plug in behavior without
+// reaching back into httpHandler internals.
+type AnnounceRequest struct {
+	Params *queryParams
+	User   *cdb.User
+	IP     string // IPv4 dotted-decimal, if the client has one
+	IPv6   string // IPv6 literal, if the client has one
+	DB     *cdb.Database
+}
+
+// AnnounceResponse is the bencoded reply body, already written by
+// whichever handler terminates the chain. Pooled marks whether Buf came
+// from the shared bufferPool — only those buffers should ever be handed
+// back to it; a middleware that short-circuits with its own
+// bytes.Buffer must leave this false.
+type AnnounceResponse struct {
+	Buf    *bytes.Buffer
+	Pooled bool
+}
+
+// AnnounceHandler is the signature every link of the announce
+// middleware chain implements, including the built-in handler at the
+// end of the chain.
+type AnnounceHandler func(ctx context.Context, req *AnnounceRequest) (*AnnounceResponse, error)
+
+// AnnounceMiddleware wraps an AnnounceHandler with pre/post logic and
+// returns the wrapped handler.
+type AnnounceMiddleware func(next AnnounceHandler) AnnounceHandler
+
+// ScrapeRequest/ScrapeResponse/ScrapeHandler/ScrapeMiddleware mirror the
+// announce versions above for the scrape path.
+type ScrapeRequest struct {
+	Params *queryParams
+	DB     *cdb.Database
+}
+
+// ScrapeResponse carries the same Pooled contract as AnnounceResponse.
+type ScrapeResponse struct {
+	Buf    *bytes.Buffer
+	Pooled bool
+}
+
+type ScrapeHandler func(ctx context.Context, req *ScrapeRequest) (*ScrapeResponse, error)
+
+type ScrapeMiddleware func(next ScrapeHandler) ScrapeHandler
+
+// announceMiddlewareFactories and scrapeMiddlewareFactories are the
+// registries middlewares add themselves to in an init() function, so
+// they can be referenced by name from config.
+var announceMiddlewareFactories = map[string]func() AnnounceMiddleware{}
+var scrapeMiddlewareFactories = map[string]func() ScrapeMiddleware{}
+
+func registerAnnounceMiddleware(name string, factory func() AnnounceMiddleware) {
+	announceMiddlewareFactories[name] = factory
+}
+
+func registerScrapeMiddleware(name string, factory func() ScrapeMiddleware) {
+	scrapeMiddlewareFactories[name] = factory
+}
+
+// runAnnounce calls the existing announce() — whose signature we don't
+// own and isn't context-aware — on a separate goroutine, and races it
+// against ctx so a caller never blocks past its deadline. If ctx wins,
+// announce() may still be running in the background; the buffer it was
+// writing into is abandoned rather than read or returned to the pool.
+func runAnnounce(ctx context.Context, pool *util.BufferPool, params *queryParams, user *cdb.User, ip string, db *cdb.Database) (buf *bytes.Buffer, timedOut bool) {
+	buf = takeBuffer(pool)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		announce(params, user, ip, db, buf)
+	}()
+
+	select {
+	case <-done:
+		return buf, false
+	case <-ctx.Done():
+		return nil, true
+	}
+}
+
+func runScrape(ctx context.Context, pool *util.BufferPool, params *queryParams, db *cdb.Database) (buf *bytes.Buffer, timedOut bool) {
+	buf = takeBuffer(pool)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		scrape(params, db, buf)
+	}()
+
+	select {
+	case <-done:
+		return buf, false
+	case <-ctx.Done():
+		return nil, true
+	}
+}
+
+// timeoutResponse builds a non-pooled failure buffer for when runAnnounce
+// or runScrape gives up waiting on ctx.
+func timeoutResponse(ctx context.Context) *bytes.Buffer {
+	buf := new(bytes.Buffer)
+	failure("Request timed out", buf, remaining(ctx, 1*time.Hour))
+	return buf
+}
+
+// announceEventLabel whitelists the event values BEP 3 defines -
+// started/stopped/completed, plus empty for a regular interval
+// announce - and collapses anything else into "other". Using the raw
+// client-supplied event string as a label value would let a client
+// inflate chihaya_announces_total's cardinality at will.
+func announceEventLabel(params *queryParams) string {
+	event, _ := params.get("event")
+	switch event {
+	case "started", "stopped", "completed":
+		return event
+	case "":
+		return "empty"
+	default:
+		return "other"
+	}
+}
+
+// buildAnnounceHandler folds the configured middleware names (in order)
+// around a handler that terminates the chain by calling into the same
+// announce() logic the tracker has always used. Unknown names are
+// logged and skipped rather than failing startup.
+func buildAnnounceHandler(pool *util.BufferPool) AnnounceHandler {
+	h := AnnounceHandler(func(ctx context.Context, req *AnnounceRequest) (*AnnounceResponse, error) {
+		buf, timedOut := runAnnounce(ctx, pool, req.Params, req.User, req.IP, req.DB)
+		if timedOut {
+			return &AnnounceResponse{Buf: timeoutResponse(ctx)}, nil
+		}
+
+		announceTotal.WithLabelValues(announceEventLabel(req.Params)).Inc()
+
+		return &AnnounceResponse{Buf: buf, Pooled: true}, nil
+	})
+
+	names := config.GetStrings("announceMiddleware")
+	for i := len(names) - 1; i >= 0; i-- {
+		factory, ok := announceMiddlewareFactories[names[i]]
+		if !ok {
+			log.Printf("Unknown announce middleware %q, skipping", names[i])
+			continue
+		}
+		h = factory()(h)
+	}
+	return h
+}
+
+func buildScrapeHandler(pool *util.BufferPool) ScrapeHandler {
+	h := ScrapeHandler(func(ctx context.Context, req *ScrapeRequest) (*ScrapeResponse, error) {
+		buf, timedOut := runScrape(ctx, pool, req.Params, req.DB)
+		if timedOut {
+			return &ScrapeResponse{Buf: timeoutResponse(ctx)}, nil
+		}
+
+		scrapeTotal.Inc()
+
+		return &ScrapeResponse{Buf: buf, Pooled: true}, nil
+	})
+
+	names := config.GetStrings("scrapeMiddleware")
+	for i := len(names) - 1; i >= 0; i-- {
+		factory, ok := scrapeMiddlewareFactories[names[i]]
+		if !ok {
+			log.Printf("Unknown scrape middleware %q, skipping", names[i])
+			continue
+		}
+		h = factory()(h)
+	}
+	return h
+}
@@ -0,0 +1,175 @@
+/*
+ * This file is part of Chihaya.
+ *
+ * Chihaya is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Chihaya is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Chihaya.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"chihaya/config"
+	"context"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	registerAnnounceMiddleware("rateLimit", newRateLimitMiddleware)
+	registerAnnounceMiddleware("ipBlocklist", newIPBlocklistMiddleware)
+	registerAnnounceMiddleware("peerIDDenylist", newPeerIDDenylistMiddleware)
+}
+
+// newRateLimitMiddleware throttles announces per passkey with a simple
+// token bucket refilled continuously at `rateLimitPerMinute` tokens per
+// minute, with `rateLimitBurst` as the bucket size.
+func newRateLimitMiddleware() AnnounceMiddleware {
+	perMinute := config.GetInt("rateLimitPerMinute")
+	if perMinute <= 0 {
+		perMinute = 60
+	}
+	burst := config.GetInt("rateLimitBurst")
+	if burst <= 0 {
+		burst = perMinute
+	}
+
+	var mutex sync.Mutex
+	buckets := make(map[string]*tokenBucket)
+
+	return func(next AnnounceHandler) AnnounceHandler {
+		return func(ctx context.Context, req *AnnounceRequest) (*AnnounceResponse, error) {
+			passkey, _ := req.Params.get("passkey")
+
+			mutex.Lock()
+			bucket, exists := buckets[passkey]
+			if !exists {
+				bucket = &tokenBucket{tokens: float64(burst), capacity: float64(burst), refillPerSecond: float64(perMinute) / 60}
+				buckets[passkey] = bucket
+			}
+			allowed := bucket.take()
+			mutex.Unlock()
+
+			if !allowed {
+				buf := new(bytes.Buffer)
+				failure("Rate limit exceeded, slow down", buf, time.Minute)
+				return &AnnounceResponse{Buf: buf}, nil
+			}
+
+			return next(ctx, req)
+		}
+	}
+}
+
+// tokenBucket is a minimal token bucket; lastRefill is lazily advanced on
+// each take() call instead of running a background ticker.
+type tokenBucket struct {
+	tokens          float64
+	capacity        float64
+	refillPerSecond float64
+	lastRefill      time.Time
+}
+
+func (b *tokenBucket) take() bool {
+	now := time.Now()
+	if !b.lastRefill.IsZero() {
+		elapsed := now.Sub(b.lastRefill).Seconds()
+		b.tokens += elapsed * b.refillPerSecond
+		if b.tokens > b.capacity {
+			b.tokens = b.capacity
+		}
+	}
+	b.lastRefill = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// newIPBlocklistMiddleware rejects announces from IPs within any CIDR
+// listed, one per line, in the file at `ipBlocklistPath`.
+func newIPBlocklistMiddleware() AnnounceMiddleware {
+	var blocks []*net.IPNet
+
+	path := config.Get("ipBlocklistPath")
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			log.Printf("ipBlocklist: %v", err)
+		} else {
+			defer f.Close()
+			scanner := bufio.NewScanner(f)
+			for scanner.Scan() {
+				line := strings.TrimSpace(scanner.Text())
+				if line == "" || strings.HasPrefix(line, "#") {
+					continue
+				}
+				_, block, err := net.ParseCIDR(line)
+				if err != nil {
+					log.Printf("ipBlocklist: invalid CIDR %q: %v", line, err)
+					continue
+				}
+				blocks = append(blocks, block)
+			}
+		}
+	}
+
+	return func(next AnnounceHandler) AnnounceHandler {
+		return func(ctx context.Context, req *AnnounceRequest) (*AnnounceResponse, error) {
+			for _, addr := range [...]string{req.IP, req.IPv6} {
+				ip := net.ParseIP(addr)
+				for _, block := range blocks {
+					if ip != nil && block.Contains(ip) {
+						buf := new(bytes.Buffer)
+						failure("Your IP is blocked", buf, 1*time.Hour)
+						return &AnnounceResponse{Buf: buf}, nil
+					}
+				}
+			}
+			return next(ctx, req)
+		}
+	}
+}
+
+// newPeerIDDenylistMiddleware rejects announces whose peer_id starts
+// with one of the comma-separated prefixes in `peerIDDenylist`.
+func newPeerIDDenylistMiddleware() AnnounceMiddleware {
+	var prefixes []string
+	for _, p := range strings.Split(config.Get("peerIDDenylist"), ",") {
+		p = strings.TrimSpace(p)
+		if p != "" {
+			prefixes = append(prefixes, p)
+		}
+	}
+
+	return func(next AnnounceHandler) AnnounceHandler {
+		return func(ctx context.Context, req *AnnounceRequest) (*AnnounceResponse, error) {
+			peerID, _ := req.Params.get("peer_id")
+			for _, prefix := range prefixes {
+				if strings.HasPrefix(peerID, prefix) {
+					buf := new(bytes.Buffer)
+					failure("Your client is not allowed on this tracker", buf, 1*time.Hour)
+					return &AnnounceResponse{Buf: buf}, nil
+				}
+			}
+			return next(ctx, req)
+		}
+	}
+}
@@ -23,14 +23,17 @@ import (
 	cdb "chihaya/database"
 	"chihaya/record"
 	"chihaya/util"
-	"fmt"
+	"context"
+	"errors"
 	"github.com/zeebo/bencode"
+	"golang.org/x/net/netutil"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
 	"path"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -41,7 +44,10 @@ type httpHandler struct {
 	bufferPool *util.BufferPool
 	waitGroup  sync.WaitGroup
 	startTime  time.Time
-	terminate  bool
+	terminate  int32 // accessed only via atomic; 0 = running, 1 = stopping
+
+	announceHandler AnnounceHandler
+	scrapeHandler   ScrapeHandler
 
 	// Internal stats
 	deltaRequests int64
@@ -155,8 +161,131 @@ func (handler *httpHandler) parseQuery(query string) (ret *queryParams, err erro
 	return
 }
 
-func (handler *httpHandler) respond(r *http.Request, buf *bytes.Buffer) {
+// lookupUser resolves passkey without blocking the caller past ctx's
+// deadline; the RLock itself still has to finish eventually, but we stop
+// waiting on it and report a timeout instead of stalling the handler.
+//
+// This is as far as ctx reaches into the database layer. announce() and
+// scrape() (see runAnnounce/runScrape) keep their original signatures -
+// they live outside this tree and take no ctx - so any locks they
+// acquire internally can't select on ctx.Done(); only the caller's total
+// wait time is bounded, via the goroutine race in runAnnounce/runScrape.
+func (handler *httpHandler) lookupUser(ctx context.Context, passkey string) (user *cdb.User, exists bool, ok bool) {
+	type result struct {
+		user   *cdb.User
+		exists bool
+	}
+	ch := make(chan result, 1)
+	go func() {
+		handler.db.UsersMutex.RLock()
+		u, e := handler.db.Users[passkey]
+		handler.db.UsersMutex.RUnlock()
+		ch <- result{u, e}
+	}()
+
+	select {
+	case r := <-ch:
+		return r.user, r.exists, true
+	case <-ctx.Done():
+		return nil, false, false
+	}
+}
+
+// remaining returns how long is left before ctx's deadline, or fallback
+// if ctx carries no deadline.
+func remaining(ctx context.Context, fallback time.Duration) time.Duration {
+	dl, ok := ctx.Deadline()
+	if !ok {
+		return fallback
+	}
+	if d := time.Until(dl); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// resolveIPs determines the IPv4 and, if present, IPv6 address a client
+// is announcing from, per BEP 7: explicit ipv4/ipv6 query params win,
+// then a literal in the legacy `ip` param, then the X-Forwarded-For/
+// X-Real-Ip proxy headers, and finally the request's own socket
+// address. A dual-stacked client can end up with both set.
+//
+// An IPv4 address is mandatory: database.Peer has no IPv6 field, so
+// announce() has
+// nowhere to store a peer that resolved to IPv6 only, and a client is
+// rejected rather than silently stored with no address. Each fallback
+// source below is tried only while ipv4 is still unresolved, so an
+// ipv6 value found earlier never suppresses IPv4 socket resolution.
+func resolveIPs(r *http.Request, params *queryParams) (ipv4, ipv6 string, err error) {
+	assign := func(candidate string) {
+		ip := net.ParseIP(candidate)
+		if ip == nil {
+			return
+		}
+		if v4 := ip.To4(); v4 != nil {
+			if ipv4 == "" {
+				ipv4 = candidate
+			}
+		} else if ipv6 == "" {
+			ipv6 = candidate
+		}
+	}
+
+	if v, exists := params.get("ipv4"); exists {
+		assign(v)
+	}
+	if v, exists := params.get("ipv6"); exists {
+		assign(v)
+	}
+
+	if ipv4 == "" {
+		if v, exists := params.get("ip"); exists {
+			assign(v)
+		}
+	}
+
+	if ipv4 == "" {
+		for _, header := range [...]string{"X-Forwarded-For", "X-Real-Ip"} {
+			values, exists := r.Header[header]
+			if !exists || len(values) == 0 {
+				continue
+			}
+			// X-Forwarded-For may be a comma-separated chain; the
+			// client's own address is the first entry.
+			assign(strings.TrimSpace(strings.Split(values[0], ",")[0]))
+			if ipv4 != "" {
+				break
+			}
+		}
+	}
+
+	if ipv4 == "" {
+		host, _, splitErr := net.SplitHostPort(r.RemoteAddr)
+		if splitErr != nil {
+			return "", "", errors.New("Failed to parse IP address")
+		}
+		assign(host)
+	}
+
+	if ipv4 == "" {
+		return "", "", errors.New("Failed to parse IP address")
+	}
+
+	return ipv4, ipv6, nil
+}
+
+func (handler *httpHandler) respond(ctx context.Context, r *http.Request, buf *bytes.Buffer) {
+	started := time.Now()
 	dir, action := path.Split(r.URL.Path)
+	// Every exit below - the early failures here, a middleware
+	// short-circuit, or the real announce()/scrape() - ends with buf
+	// holding the final bencoded reply, so observing here once covers
+	// every response instead of only the ones that reach the built-in
+	// terminal handlers.
+	defer func() {
+		observeResponse(metricsAction(action), started, buf.Bytes())
+	}()
+
 	if len(dir) != 34 {
 		failure("Malformed request - missing passkey", buf, 1*time.Hour)
 		return
@@ -171,51 +300,47 @@ func (handler *httpHandler) respond(r *http.Request, buf *bytes.Buffer) {
 		return
 	}
 
-	handler.db.UsersMutex.RLock()
-	user, exists := handler.db.Users[passkey]
-	handler.db.UsersMutex.RUnlock()
-	if !exists {
-		failure("Your passkey is invalid", buf, 1*time.Hour)
+	user, exists, ok := handler.lookupUser(ctx, passkey)
+	if !ok {
+		failure("Request timed out", buf, remaining(ctx, 1*time.Hour))
 		return
 	}
-
-	ipAddr, exists := params.get("ipv4") // first try to get ipv4 address if client sent it
 	if !exists {
-		ipAddr, exists = params.get("ip")      // then try to get public ip if sent by client
-		ipBytes := (net.ParseIP(ipAddr)).To4() // and make sure it is ipv4 one
-		if !exists || nil == ipBytes {         // finally, if there is no ip sent by client in http request or ip sent is ipv6 only ...
-			ips, exists := r.Header["X-Real-Ip"] // ... check if there is X-Real-Ip header sent by proxy?
-			if exists && len(ips) > 0 {          // if yes, assume it
-				ipAddr = ips[0]
-			} else { // if not, assume ip to be in socket
-				portIndex := len(r.RemoteAddr) - 1
-				for ; portIndex >= 0; portIndex-- {
-					if r.RemoteAddr[portIndex] == ':' {
-						break
-					}
-				}
-				if portIndex != -1 { // read ip from socket
-					ipAddr = r.RemoteAddr[0:portIndex]
-				} else { // if everything failed, abort request
-					failure("Failed to parse IP address", buf, 1*time.Hour)
-					return
-				}
-			}
-		}
+		failure("Your passkey is invalid", buf, 1*time.Hour)
+		return
 	}
 
-	ipBytes := (net.ParseIP(ipAddr)).To4()
-	if nil == ipBytes {
-		failure("Assertion failed (net.ParseIP(ipAddr)).To4() == nil)! please report this issue to staff", buf, 1*time.Hour)
+	ipv4Addr, ipv6Addr, err := resolveIPs(r, params)
+	if err != nil {
+		failure(err.Error(), buf, 1*time.Hour)
 		return
 	}
 
 	switch action {
 	case "announce":
-		announce(params, user, ipAddr, handler.db, buf)
+		resp, err := handler.announceHandler(ctx, &AnnounceRequest{Params: params, User: user, IP: ipv4Addr, IPv6: ipv6Addr, DB: handler.db})
+		if err != nil {
+			failure("Internal error processing announce", buf, 1*time.Hour)
+			return
+		}
+		buf.Write(resp.Buf.Bytes())
+		// Only buffers the shared pool actually handed out may be given
+		// back to it - a middleware that short-circuited with its own
+		// bytes.Buffer leaves Pooled false.
+		if resp.Pooled {
+			giveBuffer(handler.bufferPool, resp.Buf)
+		}
 		return
 	case "scrape":
-		scrape(params, handler.db, buf)
+		resp, err := handler.scrapeHandler(ctx, &ScrapeRequest{Params: params, DB: handler.db})
+		if err != nil {
+			failure("Internal error processing scrape", buf, 1*time.Hour)
+			return
+		}
+		buf.Write(resp.Buf.Bytes())
+		if resp.Pooled {
+			giveBuffer(handler.bufferPool, resp.Buf)
+		}
 		return
 	}
 
@@ -224,9 +349,53 @@ func (handler *httpHandler) respond(r *http.Request, buf *bytes.Buffer) {
 
 var handler *httpHandler
 var listener net.Listener
+var udp *udpHandler
+var httpServer *http.Server
+var tlsServerRef *http.Server
+
+// shutdownTimeout bounds how long Stop() waits for in-flight requests
+// to finish draining before forcibly closing their connections.
+var shutdownTimeout time.Duration
+
+// statsDone lets collectStatistics's goroutine exit on Stop() instead
+// of leaking for the lifetime of the process.
+var statsDone chan struct{}
+
+// statsDoneClose guards the close(statsDone) in Stop() so a second Stop()
+// call can't close an already-closed channel and panic. Stop() must not
+// be called before Start(): handler and statsDoneClose are still nil.
+var statsDoneClose *sync.Once
+
+// httpRequestTimeout bounds how long a single request's ServeHTTP may run
+// before its context is cancelled; zero disables the deadline.
+var httpRequestTimeout time.Duration
+
+// configDuration reads a duration-valued config key, falling back to
+// def if the key is unset or malformed.
+func configDuration(key string, def time.Duration) time.Duration {
+	raw := config.Get(key)
+	if raw == "" {
+		return def
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil {
+		log.Printf("Invalid duration for %s: %v, using default %s", key, err, def)
+		return def
+	}
+	return d
+}
 
 func (handler *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if handler.terminate {
+	if r.URL.Path == "/health" {
+		if atomic.LoadInt32(&handler.terminate) != 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		} else {
+			w.WriteHeader(http.StatusOK)
+		}
+		return
+	}
+
+	if atomic.LoadInt32(&handler.terminate) != 0 {
 		return
 	}
 	handler.waitGroup.Add(1)
@@ -239,32 +408,25 @@ func (handler *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
-	buf := handler.bufferPool.Take()
-	defer handler.bufferPool.Give(buf)
-
-	if r.URL.Path == "/stats" {
-		db := handler.db
-		peers := 0
-
-		db.UsersMutex.RLock()
-		db.TorrentsMutex.RLock()
+	if r.URL.Path == "/metrics" {
+		metricsHandler(handler.db).ServeHTTP(w, r)
+		return
+	}
 
-		for _, t := range db.Torrents {
-			peers += len(t.Leechers) + len(t.Seeders)
-		}
+	buf := takeBuffer(handler.bufferPool)
+	defer giveBuffer(handler.bufferPool, buf)
 
-		buf.WriteString(fmt.Sprintf("Uptime: %f\nUsers: %d\nTorrents: %d\nPeers: %d\nThroughput: %d rpm\n",
-			time.Since(handler.startTime).Seconds(),
-			len(db.Users),
-			len(db.Torrents),
-			peers,
-			handler.throughput,
-		))
+	ctx := r.Context()
+	if httpRequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, httpRequestTimeout)
+		defer cancel()
+	}
 
-		db.UsersMutex.RUnlock()
-		db.TorrentsMutex.RUnlock()
+	if r.URL.Path == "/stats" {
+		buf.WriteString(renderStats(handler))
 	} else {
-		handler.respond(r, buf)
+		handler.respond(ctx, r, buf)
 	}
 
 	w.Header().Add("Content-Type", "text/plain")
@@ -286,9 +448,18 @@ func Start() {
 	bufferPool := util.NewBufferPool(500, 500)
 	handler.bufferPool = bufferPool
 
-	server := &http.Server{
-		Handler:     handler,
-		ReadTimeout: 20 * time.Second,
+	handler.announceHandler = buildAnnounceHandler(bufferPool)
+	handler.scrapeHandler = buildScrapeHandler(bufferPool)
+
+	httpRequestTimeout = configDuration("httpRequestTimeout", 0)
+	shutdownTimeout = configDuration("shutdownTimeout", 10*time.Second)
+	statsDone = make(chan struct{})
+	statsDoneClose = &sync.Once{}
+
+	httpServer = &http.Server{
+		Handler:      handler,
+		ReadTimeout:  configDuration("httpReadTimeout", 20*time.Second),
+		WriteTimeout: configDuration("httpWriteTimeout", 0),
 	}
 
 	go collectStatistics()
@@ -302,11 +473,31 @@ func Start() {
 		panic(err)
 	}
 
+	if limit := config.GetInt("httpListenLimit"); limit > 0 {
+		listener = netutil.LimitListener(listener, limit)
+	}
+
+	if udpAddr := config.Get("udpAddr"); udpAddr != "" {
+		udp = newUDPHandler(handler)
+		go func() {
+			if err := udp.listenAndServe(udpAddr); err != nil {
+				log.Printf("UDP tracker stopped: %v", err)
+			}
+		}()
+	}
+
+	tlsServerRef, err = startTLS(handler)
+	if err != nil {
+		log.Printf("Failed to start TLS listener: %v", err)
+	}
+
 	/*
 	 * Behind the scenes, this works by spawning a new goroutine for each client.
 	 * This is pretty fast and scalable since goroutines are nice and efficient.
 	 */
-	_ = server.Serve(listener)
+	if err := httpServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+		log.Printf("HTTP server stopped: %v", err)
+	}
 
 	// Wait for active connections to finish processing
 	handler.waitGroup.Wait()
@@ -316,21 +507,54 @@ func Start() {
 	log.Println("Shutdown complete")
 }
 
+// Stop begins a graceful shutdown: new connections are refused and idle
+// keep-alives are closed immediately, but in-flight requests get up to
+// shutdownTimeout to finish before their sockets are forced closed.
 func Stop() {
-	// Closing the listener stops accepting connections and causes Serve to return
-	_ = listener.Close()
-	handler.terminate = true
+	atomic.StoreInt32(&handler.terminate, 1)
+
+	shutdownOne(httpServer)
+	shutdownOne(tlsServerRef)
+
+	if udpListener != nil {
+		_ = udpListener.Close()
+	}
+
+	statsDoneClose.Do(func() { close(statsDone) })
+}
+
+func shutdownOne(s *http.Server) {
+	if s == nil {
+		return
+	}
+
+	s.SetKeepAlivesEnabled(false)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := s.Shutdown(ctx); err != nil {
+		log.Printf("Graceful shutdown deadline exceeded, forcing close: %v", err)
+		_ = s.Close()
+	}
 }
 
 func collectStatistics() {
 	lastTime := time.Now()
-	for {
-		time.Sleep(time.Minute)
-		duration := time.Since(lastTime)
-		handler.throughput = int64(float64(handler.deltaRequests)/duration.Seconds()*60 + 0.5)
-		atomic.StoreInt64(&handler.deltaRequests, 0)
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
 
-		log.Printf("Throughput: %d rpm\n", handler.throughput)
-		lastTime = time.Now()
+	for {
+		select {
+		case <-statsDone:
+			return
+		case <-ticker.C:
+			duration := time.Since(lastTime)
+			handler.throughput = int64(float64(handler.deltaRequests)/duration.Seconds()*60 + 0.5)
+			atomic.StoreInt64(&handler.deltaRequests, 0)
+
+			log.Printf("Throughput: %d rpm\n", handler.throughput)
+			lastTime = time.Now()
+		}
 	}
 }
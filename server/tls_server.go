@@ -0,0 +1,121 @@
+/*
+ * This file is part of Chihaya.
+ *
+ * Chihaya is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Chihaya is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Chihaya.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"chihaya/config"
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var tlsListener net.Listener
+
+// certStore holds the currently-loaded *tls.Certificate behind an
+// atomic.Value so GetCertificate can swap it out on SIGHUP without
+// racing in-flight handshakes.
+type certStore struct {
+	value atomic.Value
+}
+
+func (c *certStore) load(certPath, keyPath string) error {
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return err
+	}
+	c.value.Store(&cert)
+	return nil
+}
+
+func (c *certStore) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.value.Load().(*tls.Certificate), nil
+}
+
+// modern cipher suites: AEAD-only, matching what the Go stdlib already
+// prioritizes under TLS 1.2, listed explicitly so weaker ciphers can
+// never be negotiated even if the runtime's defaults change.
+var tlsCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+}
+
+// startTLS spawns a second http.Server terminating TLS, sharing the
+// same handler (and therefore the same waitGroup/terminate flag) as the
+// cleartext listener. It returns nil if tlsListenAddr isn't configured.
+func startTLS(h *httpHandler) (*http.Server, error) {
+	addr := config.Get("tlsListenAddr")
+	certPath := config.Get("tlsCertPath")
+	keyPath := config.Get("tlsKeyPath")
+	if addr == "" || certPath == "" || keyPath == "" {
+		return nil, nil
+	}
+
+	store := &certStore{}
+	if err := store.load(certPath, keyPath); err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:               tls.VersionTLS12,
+		CipherSuites:             tlsCipherSuites,
+		PreferServerCipherSuites: true,
+		GetCertificate:           store.getCertificate,
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	tlsListener = tls.NewListener(ln, tlsConfig)
+
+	// Rotating a LetsEncrypt cert shouldn't require a restart: reload it
+	// from disk whenever the operator signals SIGHUP.
+	go func() {
+		sighup := make(chan os.Signal, 1)
+		signal.Notify(sighup, syscall.SIGHUP)
+		for range sighup {
+			if err := store.load(certPath, keyPath); err != nil {
+				log.Printf("Failed to reload TLS certificate: %v", err)
+			} else {
+				log.Println("Reloaded TLS certificate")
+			}
+		}
+	}()
+
+	server := &http.Server{
+		Handler:      h,
+		ReadTimeout:  configDuration("httpReadTimeout", 20*time.Second),
+		WriteTimeout: configDuration("httpWriteTimeout", 0),
+	}
+
+	go func() {
+		_ = server.Serve(tlsListener)
+	}()
+
+	return server, nil
+}
@@ -0,0 +1,401 @@
+/*
+ * This file is part of Chihaya.
+ *
+ * Chihaya is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * Chihaya is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with Chihaya.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"bytes"
+	cdb "chihaya/database"
+	"chihaya/util"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"github.com/zeebo/bencode"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BEP 15 actions.
+const (
+	udpActionConnect  uint32 = 0
+	udpActionAnnounce uint32 = 1
+	udpActionScrape   uint32 = 2
+	udpActionError    uint32 = 3
+)
+
+const (
+	udpConnectMagic       uint64 = 0x41727101980
+	udpConnectionLifetime        = 2 * time.Minute
+)
+
+var udpListener *net.UDPConn
+
+// udpHandler mirrors httpHandler, but speaks the BEP 15 UDP tracker
+// protocol. It shares the database, buffer pool, wait group and request
+// counter with the HTTP handler so collectStatistics reports on both
+// transports combined.
+type udpHandler struct {
+	db         *cdb.Database
+	bufferPool *util.BufferPool
+	waitGroup  *sync.WaitGroup
+	terminate  *int32 // shared with httpHandler.terminate; accessed only via atomic
+
+	deltaRequests *int64
+
+	connectionIDSecret [20]byte
+}
+
+func newUDPHandler(h *httpHandler) *udpHandler {
+	u := &udpHandler{
+		db:            h.db,
+		bufferPool:    h.bufferPool,
+		waitGroup:     &h.waitGroup,
+		terminate:     &h.terminate,
+		deltaRequests: &h.deltaRequests,
+	}
+	if _, err := rand.Read(u.connectionIDSecret[:]); err != nil {
+		panic(err)
+	}
+	return u
+}
+
+// newConnectionID derives a connection_id tied to the client's IP and the
+// current two-minute epoch, so a forged source IP can't reuse an
+// overheard connection_id once it has expired.
+func (u *udpHandler) newConnectionID(addr *net.UDPAddr) uint64 {
+	return u.connectionIDForEpoch(addr, time.Now().UnixNano()/int64(udpConnectionLifetime))
+}
+
+func (u *udpHandler) connectionIDForEpoch(addr *net.UDPAddr, epoch int64) uint64 {
+	mac := hmac.New(sha1.New, u.connectionIDSecret[:])
+	mac.Write(addr.IP)
+	_ = binary.Write(mac, binary.BigEndian, epoch)
+	sum := mac.Sum(nil)
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// validConnectionID accepts the current epoch and the prior one, so a
+// connection_id doesn't die mid-use right at the two-minute boundary.
+func (u *udpHandler) validConnectionID(id uint64, addr *net.UDPAddr) bool {
+	epoch := time.Now().UnixNano() / int64(udpConnectionLifetime)
+	return id == u.connectionIDForEpoch(addr, epoch) || id == u.connectionIDForEpoch(addr, epoch-1)
+}
+
+func (u *udpHandler) listenAndServe(addr string) error {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return err
+	}
+	udpListener = conn
+
+	buf := make([]byte, 2048)
+	for {
+		n, remote, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if atomic.LoadInt32(u.terminate) != 0 {
+				return nil
+			}
+			continue
+		}
+
+		packet := make([]byte, n)
+		copy(packet, buf[:n])
+
+		u.waitGroup.Add(1)
+		go func() {
+			defer u.waitGroup.Done()
+			u.handlePacket(packet, remote, conn)
+		}()
+	}
+}
+
+func (u *udpHandler) handlePacket(packet []byte, remote *net.UDPAddr, conn *net.UDPConn) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("!!! udpHandler panic !!! %v", err)
+		}
+	}()
+
+	if len(packet) < 16 {
+		return
+	}
+
+	connectionID := binary.BigEndian.Uint64(packet[0:8])
+	action := binary.BigEndian.Uint32(packet[8:12])
+	transactionID := packet[12:16]
+
+	var resp []byte
+
+	switch action {
+	case udpActionConnect:
+		resp = u.handleConnect(packet, remote, transactionID)
+	case udpActionAnnounce:
+		if !u.validConnectionID(connectionID, remote) {
+			resp = udpError("Connection ID expired", transactionID)
+			break
+		}
+		resp = u.handleAnnounce(packet, remote, transactionID)
+	case udpActionScrape:
+		if !u.validConnectionID(connectionID, remote) {
+			resp = udpError("Connection ID expired", transactionID)
+			break
+		}
+		resp = u.handleScrape(packet, transactionID)
+	default:
+		resp = udpError("Unknown action", transactionID)
+	}
+
+	if resp != nil {
+		_, _ = conn.WriteToUDP(resp, remote)
+		atomic.AddInt64(u.deltaRequests, 1)
+	}
+}
+
+func (u *udpHandler) handleConnect(packet []byte, remote *net.UDPAddr, transactionID []byte) []byte {
+	if len(packet) != 16 || binary.BigEndian.Uint64(packet[0:8]) != udpConnectMagic {
+		return udpError("Malformed connect request", transactionID)
+	}
+
+	buf := new(bytes.Buffer)
+	_ = binary.Write(buf, binary.BigEndian, udpActionConnect)
+	buf.Write(transactionID)
+	_ = binary.Write(buf, binary.BigEndian, u.newConnectionID(remote))
+	return buf.Bytes()
+}
+
+// udpAnnounceRequest is the fixed 98-byte body of a BEP 15 announce
+// request, plus a trailing length-prefixed passkey extension since UDP
+// has no URL path to carry one.
+type udpAnnounceRequest struct {
+	infoHash   string
+	peerID     string
+	downloaded uint64
+	left       uint64
+	uploaded   uint64
+	event      uint32
+	ip         uint32
+	key        uint32
+	numWant    int32
+	port       uint16
+	passkey    string
+}
+
+func parseUDPAnnounce(packet []byte) (*udpAnnounceRequest, bool) {
+	if len(packet) < 98 {
+		return nil, false
+	}
+
+	req := &udpAnnounceRequest{
+		infoHash:   string(packet[16:36]),
+		peerID:     string(packet[36:56]),
+		downloaded: binary.BigEndian.Uint64(packet[56:64]),
+		left:       binary.BigEndian.Uint64(packet[64:72]),
+		uploaded:   binary.BigEndian.Uint64(packet[72:80]),
+		event:      binary.BigEndian.Uint32(packet[80:84]),
+		ip:         binary.BigEndian.Uint32(packet[84:88]),
+		key:        binary.BigEndian.Uint32(packet[88:92]),
+		numWant:    int32(binary.BigEndian.Uint32(packet[92:96])),
+		port:       binary.BigEndian.Uint16(packet[96:98]),
+	}
+
+	if len(packet) > 99 {
+		passkeyLen := int(packet[98])
+		if len(packet) >= 99+passkeyLen {
+			req.passkey = string(packet[99 : 99+passkeyLen])
+		}
+	}
+
+	return req, true
+}
+
+func (u *udpHandler) handleAnnounce(packet []byte, remote *net.UDPAddr, transactionID []byte) []byte {
+	req, ok := parseUDPAnnounce(packet)
+	if !ok {
+		return udpError("Malformed announce request", transactionID)
+	}
+
+	if req.passkey == "" {
+		return udpError("Your passkey is invalid", transactionID)
+	}
+
+	u.db.UsersMutex.RLock()
+	user, exists := u.db.Users[req.passkey]
+	u.db.UsersMutex.RUnlock()
+	if !exists {
+		return udpError("Your passkey is invalid", transactionID)
+	}
+
+	ipAddr := remote.IP.String()
+	if req.ip != 0 {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, req.ip)
+		ipAddr = ip.String()
+	} else if remote.IP.To4() == nil {
+		return udpError("Failed to parse IP address", transactionID)
+	}
+
+	params := &queryParams{params: map[string]string{
+		"info_hash":  req.infoHash,
+		"peer_id":    req.peerID,
+		"downloaded": strconv.FormatUint(req.downloaded, 10),
+		"left":       strconv.FormatUint(req.left, 10),
+		"uploaded":   strconv.FormatUint(req.uploaded, 10),
+		"port":       strconv.FormatUint(uint64(req.port), 10),
+		"key":        strconv.FormatUint(uint64(req.key), 10),
+		"compact":    "1",
+	}}
+	if req.numWant >= 0 {
+		params.params["numwant"] = strconv.FormatInt(int64(req.numWant), 10)
+	}
+	switch req.event {
+	case 1:
+		params.params["event"] = "completed"
+	case 2:
+		params.params["event"] = "started"
+	case 3:
+		params.params["event"] = "stopped"
+	}
+
+	ctx := context.Background()
+	if httpRequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, httpRequestTimeout)
+		defer cancel()
+	}
+
+	// BEP 15's base announce request only carries an IPv4 address, so
+	// there's no IPv6 literal to pass here in the first place. Peer
+	// storage doesn't carry an IPv6 field yet either (chunk0-5), so this
+	// stays v4-only until that lands - revisit the call once it does.
+	buf, timedOut := runAnnounce(ctx, u.bufferPool, params, user, ipAddr, u.db)
+	if timedOut {
+		return udpError("Request timed out", transactionID)
+	}
+	defer giveBuffer(u.bufferPool, buf)
+
+	resp, err := udpAnnounceResponse(buf.Bytes(), transactionID)
+	if err != nil {
+		return udpError("Internal error building announce response", transactionID)
+	}
+	return resp
+}
+
+// udpAnnounceResponse decodes the bencoded announce reply that the
+// shared announce() logic already knows how to build and repacks it
+// into the fixed BEP 15 binary layout.
+func udpAnnounceResponse(bencoded []byte, transactionID []byte) ([]byte, error) {
+	var reply struct {
+		FailureReason string `bencode:"failure reason"`
+		Interval      int32  `bencode:"interval"`
+		Complete      int32  `bencode:"complete"`
+		Incomplete    int32  `bencode:"incomplete"`
+		Peers         string `bencode:"peers"`
+	}
+	if err := bencode.DecodeBytes(bencoded, &reply); err != nil {
+		return nil, err
+	}
+	if reply.FailureReason != "" {
+		return udpError(reply.FailureReason, transactionID), nil
+	}
+
+	buf := new(bytes.Buffer)
+	_ = binary.Write(buf, binary.BigEndian, udpActionAnnounce)
+	buf.Write(transactionID)
+	_ = binary.Write(buf, binary.BigEndian, reply.Interval)
+	_ = binary.Write(buf, binary.BigEndian, reply.Incomplete)
+	_ = binary.Write(buf, binary.BigEndian, reply.Complete)
+	buf.WriteString(reply.Peers)
+	return buf.Bytes(), nil
+}
+
+func (u *udpHandler) handleScrape(packet []byte, transactionID []byte) []byte {
+	if len(packet) < 16 || (len(packet)-16)%20 != 0 {
+		return udpError("Malformed scrape request", transactionID)
+	}
+
+	var infoHashes []string
+	for i := 16; i+20 <= len(packet); i += 20 {
+		infoHashes = append(infoHashes, string(packet[i:i+20]))
+	}
+	if len(infoHashes) == 0 {
+		return udpError("Malformed scrape request", transactionID)
+	}
+
+	params := &queryParams{params: map[string]string{"info_hash": infoHashes[0]}, infoHashes: infoHashes}
+
+	ctx := context.Background()
+	if httpRequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, httpRequestTimeout)
+		defer cancel()
+	}
+
+	buf, timedOut := runScrape(ctx, u.bufferPool, params, u.db)
+	if timedOut {
+		return udpError("Request timed out", transactionID)
+	}
+	defer giveBuffer(u.bufferPool, buf)
+
+	resp, err := udpScrapeResponse(buf.Bytes(), infoHashes, transactionID)
+	if err != nil {
+		return udpError("Internal error building scrape response", transactionID)
+	}
+	return resp
+}
+
+func udpScrapeResponse(bencoded []byte, infoHashes []string, transactionID []byte) ([]byte, error) {
+	var reply struct {
+		Files map[string]struct {
+			Complete   int32 `bencode:"complete"`
+			Downloaded int32 `bencode:"downloaded"`
+			Incomplete int32 `bencode:"incomplete"`
+		} `bencode:"files"`
+	}
+	if err := bencode.DecodeBytes(bencoded, &reply); err != nil {
+		return nil, err
+	}
+
+	buf := new(bytes.Buffer)
+	_ = binary.Write(buf, binary.BigEndian, udpActionScrape)
+	buf.Write(transactionID)
+	for _, hash := range infoHashes {
+		file := reply.Files[hash]
+		_ = binary.Write(buf, binary.BigEndian, file.Complete)
+		_ = binary.Write(buf, binary.BigEndian, file.Downloaded)
+		_ = binary.Write(buf, binary.BigEndian, file.Incomplete)
+	}
+	return buf.Bytes(), nil
+}
+
+func udpError(message string, transactionID []byte) []byte {
+	buf := new(bytes.Buffer)
+	_ = binary.Write(buf, binary.BigEndian, udpActionError)
+	buf.Write(transactionID)
+	buf.WriteString(message)
+	return buf.Bytes()
+}